@@ -0,0 +1,150 @@
+package reporter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	client "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api/write"
+	influxdb1 "github.com/influxdata/influxdb1-client/v2"
+)
+
+// Point is a single measurement write, independent of which InfluxDB
+// protocol version a Backend speaks.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// Backend writes points to an InfluxDB server. Reporter is agnostic to the
+// protocol version; V2Backend and V1Backend adapt the v2 and v1 line
+// protocol clients to this interface.
+type Backend interface {
+	WritePoints(ctx context.Context, points []Point) error
+	Ping(ctx context.Context) bool
+	Close() error
+}
+
+// V2Backend writes points to an InfluxDB 2.x server using org/bucket/token
+// authentication.
+type V2Backend struct {
+	serverURL string
+	token     string
+	org       string
+	bucket    string
+
+	client client.Client
+}
+
+// NewV2Backend creates a Backend that writes to an InfluxDB 2.x server.
+func NewV2Backend(serverURL, org, bucket, token string) (*V2Backend, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse InfluxDB serverURL %s: %w", serverURL, err)
+	}
+
+	b := &V2Backend{
+		serverURL: u.String(),
+		token:     token,
+		org:       org,
+		bucket:    bucket,
+	}
+	b.connect()
+	return b, nil
+}
+
+func (b *V2Backend) connect() {
+	b.client = client.NewClient(b.serverURL, b.token)
+}
+
+func (b *V2Backend) WritePoints(ctx context.Context, points []Point) error {
+	pts := make([]*write.Point, len(points))
+	for i, p := range points {
+		pts[i] = write.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
+	}
+	return b.client.WriteAPIBlocking(b.org, b.bucket).WritePoint(ctx, pts...)
+}
+
+func (b *V2Backend) Ping(ctx context.Context) bool {
+	ready, err := b.client.Ready(ctx)
+	if !ready {
+		log.Printf("got error while sending a ping to InfluxDB, trying to recreate client. err=%v", err)
+		b.connect()
+	}
+	return ready
+}
+
+func (b *V2Backend) Close() error {
+	b.client.Close()
+	return nil
+}
+
+// V1Backend writes points to an InfluxDB 1.x server using
+// database/username/password authentication.
+type V1Backend struct {
+	database        string
+	retentionPolicy string
+	consistency     string
+
+	client influxdb1.Client
+}
+
+// NewV1Backend creates a Backend that writes to an InfluxDB 1.x server.
+// retentionPolicy and consistency may be left empty to use the server's
+// defaults.
+func NewV1Backend(serverURL, database, username, password, retentionPolicy, consistency string) (*V1Backend, error) {
+	c, err := influxdb1.NewHTTPClient(influxdb1.HTTPConfig{
+		Addr:     serverURL,
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create InfluxDB v1 client: %w", err)
+	}
+
+	return &V1Backend{
+		database:        database,
+		retentionPolicy: retentionPolicy,
+		consistency:     consistency,
+		client:          c,
+	}, nil
+}
+
+func (b *V1Backend) WritePoints(ctx context.Context, points []Point) error {
+	bp, err := influxdb1.NewBatchPoints(influxdb1.BatchPointsConfig{
+		Database:         b.database,
+		RetentionPolicy:  b.retentionPolicy,
+		WriteConsistency: b.consistency,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create InfluxDB v1 batch: %w", err)
+	}
+
+	for _, p := range points {
+		pt, err := influxdb1.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
+		if err != nil {
+			return fmt.Errorf("unable to create InfluxDB v1 point: %w", err)
+		}
+		bp.AddPoint(pt)
+	}
+
+	return b.client.Write(bp)
+}
+
+func (b *V1Backend) Ping(ctx context.Context) bool {
+	_, _, err := b.client.Ping(5 * time.Second)
+	if err != nil {
+		log.Printf("got error while sending a ping to InfluxDB. err=%v", err)
+		return false
+	}
+	return true
+}
+
+func (b *V1Backend) Close() error {
+	return b.client.Close()
+}
@@ -3,87 +3,341 @@ package reporter
 import (
 	"context"
 	"fmt"
-	"log"
-	"net/url"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	client "github.com/influxdata/influxdb-client-go"
-	"github.com/influxdata/influxdb-client-go/api/write"
 	"github.com/rcrowley/go-metrics"
 )
 
-type reporter struct {
-	registry       metrics.Registry
-	interval       time.Duration
-	align          bool
-	serverURL      string
-	organizationId string
-	bucketId       string
+// defaultPercentiles matches the percentiles this package has always
+// reported.
+var defaultPercentiles = []float64{0.5, 0.75, 0.95, 0.99}
 
-	measurement string
-	token       string
-	tags        map[string]string
+// Reporter posts metrics from a go-metrics registry to InfluxDB at a fixed
+// interval until it is stopped.
+type Reporter struct {
+	registry metrics.Registry
+	interval time.Duration
+	align    bool
 
-	client client.Client
+	measurement  string
+	tags         map[string]string
+	reportDeltas bool
+	legacyLayout bool
+
+	percentiles     []float64
+	percentileNames []string
+	durationUnit    time.Duration
+	rateUnit        time.Duration
+	fieldName       func(metricName, stat string) string
+
+	filter  func(name string) bool
+	renamer func(name string) string
+	tagger  func(name string, metric interface{}) map[string]string
+
+	backend Backend
+
+	deltaMu    sync.Mutex
+	deltaCache map[string]int64
+
+	errors chan error
+	done   chan struct{}
+	wg     sync.WaitGroup
+	stop   sync.Once
+}
+
+// Config holds the full set of options accepted by InfluxDBWithConfig.
+type Config struct {
+	Registry metrics.Registry
+	Interval time.Duration
+	Backend  Backend
+
+	Measurement     string
+	Tags            map[string]string
+	AlignTimestamps bool
+	ReportDeltas    bool
+	LegacyLayout    bool
+
+	// Percentiles defaults to [0.5, 0.75, 0.95, 0.99] for histograms and
+	// timers.
+	Percentiles []float64
+
+	// DurationUnit scales timer min/max/mean/stddev/percentile values,
+	// which go-metrics tracks in nanoseconds. Defaults to time.Nanosecond,
+	// i.e. no scaling.
+	DurationUnit time.Duration
+
+	// RateUnit scales meter and timer rates (m1/m5/m15/meanrate), which
+	// go-metrics tracks per second. Defaults to time.Second, i.e. no
+	// scaling.
+	RateUnit time.Duration
+
+	// FieldNameFunc builds the field name written for a given metric name
+	// and statistic (e.g. "count", "p99", or, under LegacyLayout, the
+	// metric kind). Defaults to the stat name alone, or under
+	// LegacyLayout to "<metricName>.<stat>".
+	FieldNameFunc func(metricName, stat string) string
+}
+
+// Option customizes a Reporter beyond what Config exposes. Options are
+// applied in the order given, after the Config defaults.
+type Option func(*Reporter)
+
+// WithFilter restricts reporting to metrics for which include returns true.
+// Metrics are evaluated by their registry name before WithRenamer is
+// applied.
+func WithFilter(include func(name string) bool) Option {
+	return func(r *Reporter) {
+		r.filter = include
+	}
 }
 
-// InfluxDB starts a InfluxDB reporter which will post the metrics
-// from the given registry at each interval.
-func InfluxDB(registry metrics.Registry, interval time.Duration, serverUrl, organizationID, bucketID, measurement, token string, alignTimestamps bool) {
-	InfluxDBWithTags(registry, interval, serverUrl, organizationID, bucketID, measurement, token, map[string]string{}, alignTimestamps)
+// WithRenamer rewrites a metric's registry name before it is written, e.g.
+// to strip or replace a prefix.
+func WithRenamer(rename func(name string) string) Option {
+	return func(r *Reporter) {
+		r.renamer = rename
+	}
+}
+
+// WithTagger attaches extra tags to a metric's point(s), derived from its
+// registry name and the metric itself, e.g. parsing
+// "http.request.GET./users.count" into method/route tags. tagger is called
+// with the metric's original (pre-WithRenamer) name.
+func WithTagger(tagger func(name string, metric interface{}) map[string]string) Option {
+	return func(r *Reporter) {
+		r.tagger = tagger
+	}
+}
+
+// New creates a Reporter that writes the metrics from the given registry to
+// backend at each interval with the specified tags. Call Start to begin
+// reporting; the reporter does nothing until Start is called.
+//
+// When reportDeltas is true, Counter and Meter values are written as the
+// delta since the previous tick instead of their monotonic total; a metric
+// is skipped on the tick it is first observed, since there is no baseline
+// to diff against yet.
+//
+// By default each histogram/timer/meter is written as a single Point per
+// tick, tagged with the metric name, so that its statistics live in one
+// series. Set legacyLayout to true to instead write one Point per
+// statistic, keyed by a "<name>.<kind>" field, matching the layout this
+// package used before it supported LegacyLayout.
+func New(registry metrics.Registry, interval time.Duration, backend Backend, measurement string, tags map[string]string, alignTimestamps, reportDeltas, legacyLayout bool, opts ...Option) (*Reporter, error) {
+	return InfluxDBWithConfig(Config{
+		Registry:        registry,
+		Interval:        interval,
+		Backend:         backend,
+		Measurement:     measurement,
+		Tags:            tags,
+		AlignTimestamps: alignTimestamps,
+		ReportDeltas:    reportDeltas,
+		LegacyLayout:    legacyLayout,
+	}, opts...)
+}
+
+// InfluxDBV2 creates a Reporter that writes to an InfluxDB 2.x server using
+// org/bucket/token authentication.
+func InfluxDBV2(registry metrics.Registry, interval time.Duration, serverURL, organizationID, bucketID, measurement, token string, tags map[string]string, alignTimestamps, reportDeltas, legacyLayout bool, opts ...Option) (*Reporter, error) {
+	backend, err := NewV2Backend(serverURL, organizationID, bucketID, token)
+	if err != nil {
+		return nil, err
+	}
+	return New(registry, interval, backend, measurement, tags, alignTimestamps, reportDeltas, legacyLayout, opts...)
 }
 
-// InfluxDBWithTags starts a InfluxDB reporter which will post the metrics
-// from the given registry at each 'd' interval with the specified 'tags'.
-func InfluxDBWithTags(registry metrics.Registry, interval time.Duration, serverUrl, organizationID, bucketID, measurement, token string, tags map[string]string, alignTimestamps bool) {
-	u, err := url.Parse(serverUrl)
+// InfluxDBV1 creates a Reporter that writes to an InfluxDB 1.x server using
+// database/username/password authentication. retentionPolicy and
+// consistency may be left empty to use the server's defaults.
+func InfluxDBV1(registry metrics.Registry, interval time.Duration, serverURL, database, username, password, retentionPolicy, consistency, measurement string, tags map[string]string, alignTimestamps, reportDeltas, legacyLayout bool, opts ...Option) (*Reporter, error) {
+	backend, err := NewV1Backend(serverURL, database, username, password, retentionPolicy, consistency)
 	if err != nil {
-		log.Printf("unable to parse InfluxDB serverURL %s. err=%v", serverUrl, err)
-		return
+		return nil, err
 	}
+	return New(registry, interval, backend, measurement, tags, alignTimestamps, reportDeltas, legacyLayout, opts...)
+}
+
+// InfluxDBWithConfig creates a Reporter from a Config, for callers that need
+// control over percentiles, duration/rate units or field naming beyond what
+// New, InfluxDBV1 and InfluxDBV2 expose.
+func InfluxDBWithConfig(cfg Config, opts ...Option) (*Reporter, error) {
+	if cfg.Tags == nil {
+		cfg.Tags = map[string]string{}
+	}
+	if len(cfg.Percentiles) == 0 {
+		cfg.Percentiles = defaultPercentiles
+	}
+	if cfg.DurationUnit == 0 {
+		cfg.DurationUnit = time.Nanosecond
+	}
+	if cfg.RateUnit == 0 {
+		cfg.RateUnit = time.Second
+	}
+	if cfg.FieldNameFunc == nil {
+		if cfg.LegacyLayout {
+			cfg.FieldNameFunc = func(metricName, stat string) string {
+				return fmt.Sprintf("%s.%s", metricName, stat)
+			}
+		} else {
+			cfg.FieldNameFunc = func(_, stat string) string {
+				return stat
+			}
+		}
+	}
+
+	r := &Reporter{
+		registry:        cfg.Registry,
+		interval:        cfg.Interval,
+		measurement:     cfg.Measurement,
+		tags:            cfg.Tags,
+		align:           cfg.AlignTimestamps,
+		reportDeltas:    cfg.ReportDeltas,
+		legacyLayout:    cfg.LegacyLayout,
+		percentiles:     cfg.Percentiles,
+		percentileNames: percentileNames(cfg.Percentiles),
+		durationUnit:    cfg.DurationUnit,
+		rateUnit:        cfg.RateUnit,
+		fieldName:       cfg.FieldNameFunc,
+		backend:         cfg.Backend,
+		deltaCache:      map[string]int64{},
+		errors:          make(chan error, 1),
+		done:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+// percentileNames derives a field name for each percentile, e.g. 0.5 ->
+// "p50", 0.999 -> "p999". Percentiles are rounded to the nearest basis
+// point before formatting, so that float imprecision in the input (e.g.
+// 0.333) can't leak extra digits into the generated name.
+func percentileNames(percentiles []float64) []string {
+	names := make([]string, len(percentiles))
+	for i, p := range percentiles {
+		bp := math.Round(p * 10000)
+		s := strconv.FormatFloat(bp/100, 'f', -1, 64)
+		names[i] = "p" + strings.Replace(s, ".", "", 1)
+	}
+	return names
+}
+
+// delta returns the change in count since the last call with this name, and
+// whether a prior baseline existed. It updates the cache as a side effect.
+func (r *Reporter) delta(name string, count int64) (int64, bool) {
+	r.deltaMu.Lock()
+	defer r.deltaMu.Unlock()
+
+	last, ok := r.deltaCache[name]
+	r.deltaCache[name] = count
+	if !ok {
+		return 0, false
+	}
+	return count - last, true
+}
+
+// scaleDuration converts a nanosecond duration value to r.durationUnit.
+func (r *Reporter) scaleDuration(ns float64) float64 {
+	return ns / float64(r.durationUnit.Nanoseconds())
+}
+
+// scaleVariance converts a variance computed over nanosecond durations to
+// r.durationUnit. Variance carries squared units, so it scales by the
+// square of the factor scaleDuration uses.
+func (r *Reporter) scaleVariance(nsSquared float64) float64 {
+	unit := float64(r.durationUnit.Nanoseconds())
+	return nsSquared / (unit * unit)
+}
+
+// scaleRate converts a per-second rate to r.rateUnit.
+func (r *Reporter) scaleRate(perSecond float64) float64 {
+	return perSecond * r.rateUnit.Seconds()
+}
 
-	rep := &reporter{
-		registry:       registry,
-		interval:       interval,
-		serverURL:      u.String(),
-		organizationId: organizationID,
-		bucketId:       bucketID,
-		measurement:    measurement,
-		token:          token,
-		tags:           tags,
-		align:          alignTimestamps,
+// mergedTags copies r.tags and overlays extra on top of it.
+func (r *Reporter) mergedTags(extra map[string]string) map[string]string {
+	m := make(map[string]string, len(r.tags)+len(extra))
+	for k, v := range r.tags {
+		m[k] = v
+	}
+	for k, v := range extra {
+		m[k] = v
 	}
-	rep.makeClient()
-	rep.run()
+	return m
+}
+
+// Start begins reporting metrics in a background goroutine. Reporting
+// continues until ctx is canceled or Stop is called.
+func (r *Reporter) Start(ctx context.Context) {
+	r.wg.Add(1)
+	go r.run(ctx)
+}
+
+// Stop ends reporting, writes a final batch of any pending metrics and
+// closes the underlying InfluxDB backend. It is safe to call Stop more than
+// once; only the first call has effect.
+func (r *Reporter) Stop() error {
+	var err error
+	r.stop.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+		err = r.Flush(context.Background())
+		r.backend.Close()
+	})
+	return err
+}
+
+// Flush immediately writes the current metrics to InfluxDB without waiting
+// for the next tick.
+func (r *Reporter) Flush(ctx context.Context) error {
+	return r.send(ctx)
+}
+
+// Errors returns a channel on which asynchronous reporting errors are
+// delivered. The channel is never closed; callers that don't drain it will
+// simply miss later errors, since delivery is best-effort.
+func (r *Reporter) Errors() <-chan error {
+	return r.errors
 }
 
-func (r *reporter) makeClient() {
-	r.client = client.NewClient(r.serverURL, r.token)
+func (r *Reporter) reportError(err error) {
+	select {
+	case r.errors <- err:
+	default:
+	}
 }
 
-func (r *reporter) run() {
-	intervalTicker := time.Tick(r.interval)
-	pingTicker := time.Tick(time.Second * 5)
+func (r *Reporter) run(ctx context.Context) {
+	defer r.wg.Done()
+
+	intervalTicker := time.NewTicker(r.interval)
+	pingTicker := time.NewTicker(time.Second * 5)
+	defer intervalTicker.Stop()
+	defer pingTicker.Stop()
 
 	for {
 		select {
-		case <-intervalTicker:
-			if err := r.send(); err != nil {
-				log.Printf("unable to send metrics to InfluxDB. err=%v", err)
-			}
-		case <-pingTicker:
-			ready, err := r.client.Ready(context.Background())
-
-			if !ready {
-				log.Printf("got error while sending a ping to InfluxDB, trying to recreate client. err=%v", err)
-				r.makeClient()
+		case <-intervalTicker.C:
+			if err := r.send(ctx); err != nil {
+				r.reportError(fmt.Errorf("unable to send metrics to InfluxDB: %w", err))
 			}
+		case <-pingTicker.C:
+			r.backend.Ping(ctx)
+		case <-r.done:
+			return
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (r *reporter) send() error {
-	var pts []*write.Point
+func (r *Reporter) send(ctx context.Context) error {
+	var pts []Point
 
 	now := time.Now()
 	if r.align {
@@ -91,40 +345,39 @@ func (r *reporter) send() error {
 	}
 
 	r.registry.Each(func(name string, i interface{}) {
+		if r.filter != nil && !r.filter(name) {
+			return
+		}
+
+		tags := r.tags
+		if r.tagger != nil {
+			tags = r.mergedTags(r.tagger(name, i))
+		}
+		if r.renamer != nil {
+			name = r.renamer(name)
+		}
+
 		switch metric := i.(type) {
 		case metrics.Counter:
 			ms := metric.Snapshot()
-			pts = append(pts, write.NewPoint(
-				r.measurement,
-				r.tags,
-				map[string]interface{}{
-					fmt.Sprintf("%s.count", name): ms.Count(),
-				},
-				now,
-			))
+			count := ms.Count()
+			if r.reportDeltas {
+				delta, ok := r.delta(name, count)
+				if !ok {
+					return
+				}
+				count = delta
+			}
+			pts = append(pts, r.scalarPoint(name, "count", "count", now, count, tags))
 		case metrics.Gauge:
 			ms := metric.Snapshot()
-			pts = append(pts, write.NewPoint(
-				r.measurement,
-				r.tags,
-				map[string]interface{}{
-					fmt.Sprintf("%s.gauge", name): ms.Value(),
-				},
-				now,
-			))
+			pts = append(pts, r.scalarPoint(name, "value", "gauge", now, ms.Value(), tags))
 		case metrics.GaugeFloat64:
 			ms := metric.Snapshot()
-			pts = append(pts, write.NewPoint(
-				r.measurement,
-				r.tags,
-				map[string]interface{}{
-					fmt.Sprintf("%s.gauge", name): ms.Value(),
-				},
-				now,
-			))
+			pts = append(pts, r.scalarPoint(name, "value", "gauge", now, ms.Value(), tags))
 		case metrics.Histogram:
 			ms := metric.Snapshot()
-			ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99})
+			ps := ms.Percentiles(r.percentiles)
 			fields := map[string]float64{
 				"count":    float64(ms.Count()),
 				"max":      float64(ms.Max()),
@@ -132,76 +385,126 @@ func (r *reporter) send() error {
 				"min":      float64(ms.Min()),
 				"stddev":   ms.StdDev(),
 				"variance": ms.Variance(),
-				"p50":      ps[0],
-				"p75":      ps[1],
-				"p95":      ps[2],
-				"p99":      ps[3],
 			}
-			for k, v := range fields {
-				pts = append(pts, write.NewPoint(
-					r.measurement,
-					bucketTags(k, r.tags),
-					map[string]interface{}{
-						fmt.Sprintf("%s.histogram", name): v,
-					},
-					now,
-				))
-
+			for i, pname := range r.percentileNames {
+				fields[pname] = ps[i]
 			}
+			pts = append(pts, r.statPoints(name, "histogram", now, fields, tags)...)
 		case metrics.Meter:
 			ms := metric.Snapshot()
-			fields := map[string]float64{
-				"count": float64(ms.Count()),
-				"m1":    ms.Rate1(),
-				"m5":    ms.Rate5(),
-				"m15":   ms.Rate15(),
-				"mean":  ms.RateMean(),
+			count := ms.Count()
+			if r.reportDeltas {
+				delta, ok := r.delta(name, count)
+				if !ok {
+					return
+				}
+				count = delta
 			}
-			for k, v := range fields {
-				pts = append(pts, write.NewPoint(
-					r.measurement,
-					bucketTags(k, r.tags),
-					map[string]interface{}{
-						fmt.Sprintf("%s.meter", name): v,
-					},
-					now,
-				))
+			fields := map[string]float64{
+				"count": float64(count),
+				"m1":    r.scaleRate(ms.Rate1()),
+				"m5":    r.scaleRate(ms.Rate5()),
+				"m15":   r.scaleRate(ms.Rate15()),
+				"mean":  r.scaleRate(ms.RateMean()),
 			}
+			pts = append(pts, r.statPoints(name, "meter", now, fields, tags)...)
 
 		case metrics.Timer:
 			ms := metric.Snapshot()
-			ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99})
+			ps := ms.Percentiles(r.percentiles)
 			fields := map[string]float64{
 				"count":    float64(ms.Count()),
-				"max":      float64(ms.Max()),
-				"mean":     ms.Mean(),
-				"min":      float64(ms.Min()),
-				"stddev":   ms.StdDev(),
-				"variance": ms.Variance(),
-				"p50":      ps[0],
-				"p75":      ps[1],
-				"p95":      ps[2],
-				"p99":      ps[3],
-				"m1":       ms.Rate1(),
-				"m5":       ms.Rate5(),
-				"m15":      ms.Rate15(),
-				"meanrate": ms.RateMean(),
+				"max":      r.scaleDuration(float64(ms.Max())),
+				"mean":     r.scaleDuration(ms.Mean()),
+				"min":      r.scaleDuration(float64(ms.Min())),
+				"stddev":   r.scaleDuration(ms.StdDev()),
+				"variance": r.scaleVariance(ms.Variance()),
+				"m1":       r.scaleRate(ms.Rate1()),
+				"m5":       r.scaleRate(ms.Rate5()),
+				"m15":      r.scaleRate(ms.Rate15()),
+				"meanrate": r.scaleRate(ms.RateMean()),
 			}
-			for k, v := range fields {
-				pts = append(pts, write.NewPoint(
-					r.measurement,
-					bucketTags(k, r.tags),
-					map[string]interface{}{
-						fmt.Sprintf("%s.timer", name): v,
-					},
-					now,
-				))
+			for i, pname := range r.percentileNames {
+				fields[pname] = r.scaleDuration(ps[i])
 			}
+			pts = append(pts, r.statPoints(name, "timer", now, fields, tags)...)
 		}
 	})
 
-	err := r.client.WriteAPIBlocking(r.organizationId, r.bucketId).WritePoint(context.Background(), pts...)
-	return err
+	if len(pts) == 0 {
+		return nil
+	}
+
+	return r.backend.WritePoints(ctx, pts)
+}
+
+// scalarPoint builds the Point for a single-valued metric (Counter, Gauge,
+// GaugeFloat64). stat is its default-layout field name ("count" or
+// "value"); legacyKind is the legacy field suffix ("count" or "gauge").
+// tags is the metric's base tag set (r.tags plus any WithTagger additions).
+func (r *Reporter) scalarPoint(name, stat, legacyKind string, now time.Time, value interface{}, tags map[string]string) Point {
+	if r.legacyLayout {
+		return Point{
+			Measurement: r.measurement,
+			Tags:        tags,
+			Fields: map[string]interface{}{
+				r.fieldName(name, legacyKind): value,
+			},
+			Time: now,
+		}
+	}
+	return Point{
+		Measurement: r.measurement,
+		Tags:        metricTags(name, tags),
+		Fields: map[string]interface{}{
+			r.fieldName(name, stat): value,
+		},
+		Time: now,
+	}
+}
+
+// statPoints renders fields for name. Under the default layout that's a
+// single Point per metric, tagged with the metric name and one field per
+// statistic. Under legacyLayout it's one Point per statistic, each tagged
+// with "bucketId" and keyed by a single "<name>.<kind>" field, matching
+// this package's pre-LegacyLayout behavior. tags is the metric's base tag
+// set (r.tags plus any WithTagger additions).
+func (r *Reporter) statPoints(name, kind string, now time.Time, fields map[string]float64, tags map[string]string) []Point {
+	if !r.legacyLayout {
+		f := make(map[string]interface{}, len(fields))
+		for stat, v := range fields {
+			f[r.fieldName(name, stat)] = v
+		}
+		return []Point{{
+			Measurement: r.measurement,
+			Tags:        metricTags(name, tags),
+			Fields:      f,
+			Time:        now,
+		}}
+	}
+
+	fieldKey := r.fieldName(name, kind)
+	pts := make([]Point, 0, len(fields))
+	for stat, v := range fields {
+		pts = append(pts, Point{
+			Measurement: r.measurement,
+			Tags:        bucketTags(stat, tags),
+			Fields: map[string]interface{}{
+				fieldKey: v,
+			},
+			Time: now,
+		})
+	}
+	return pts
+}
+
+func metricTags(name string, tags map[string]string) map[string]string {
+	m := map[string]string{}
+	for tk, tv := range tags {
+		m[tk] = tv
+	}
+	m["metric"] = name
+	return m
 }
 
 func bucketTags(bucket string, tags map[string]string) map[string]string {
@@ -0,0 +1,155 @@
+package reporter
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+func TestPercentileNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		percentiles []float64
+		want        []string
+	}{
+		{
+			name:        "defaults",
+			percentiles: []float64{0.5, 0.75, 0.95, 0.99},
+			want:        []string{"p50", "p75", "p95", "p99"},
+		},
+		{
+			name:        "three and four decimal nines",
+			percentiles: []float64{0.999, 0.9999},
+			want:        []string{"p999", "p9999"},
+		},
+		{
+			name:        "float imprecise input",
+			percentiles: []float64{0.333},
+			want:        []string{"p333"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := percentileNames(tt.percentiles)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("percentileNames(%v) = %v, want %v", tt.percentiles, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReporterDelta(t *testing.T) {
+	r := &Reporter{deltaCache: map[string]int64{}}
+
+	delta, ok := r.delta("requests", 10)
+	if ok {
+		t.Fatalf("delta on first observation: ok = true, want false (no baseline yet)")
+	}
+	if delta != 0 {
+		t.Fatalf("delta on first observation = %d, want 0", delta)
+	}
+
+	delta, ok = r.delta("requests", 25)
+	if !ok {
+		t.Fatalf("delta on second observation: ok = false, want true")
+	}
+	if delta != 15 {
+		t.Fatalf("delta on second observation = %d, want 15", delta)
+	}
+
+	delta, ok = r.delta("requests", 20)
+	if !ok {
+		t.Fatalf("delta after a decrease: ok = false, want true")
+	}
+	if delta != -5 {
+		t.Fatalf("delta after a decrease = %d, want -5", delta)
+	}
+}
+
+func newTestReporter(t *testing.T, legacyLayout bool) *Reporter {
+	t.Helper()
+	r, err := InfluxDBWithConfig(Config{
+		Measurement:  "metrics",
+		Tags:         map[string]string{"host": "box1"},
+		LegacyLayout: legacyLayout,
+	})
+	if err != nil {
+		t.Fatalf("InfluxDBWithConfig() error = %v", err)
+	}
+	return r
+}
+
+func fieldKeys(p Point) []string {
+	keys := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestStatPointsDefaultLayout(t *testing.T) {
+	r := newTestReporter(t, false)
+
+	pts := r.statPoints("req.latency", "timer", testNow, map[string]float64{
+		"count": 5,
+		"mean":  1.5,
+		"p99":   9.9,
+	}, r.tags)
+
+	if len(pts) != 1 {
+		t.Fatalf("got %d points, want 1 (one point per metric)", len(pts))
+	}
+
+	p := pts[0]
+	if p.Measurement != "metrics" {
+		t.Errorf("Measurement = %q, want %q", p.Measurement, "metrics")
+	}
+	wantTags := map[string]string{"host": "box1", "metric": "req.latency"}
+	if !reflect.DeepEqual(p.Tags, wantTags) {
+		t.Errorf("Tags = %v, want %v", p.Tags, wantTags)
+	}
+	wantFields := []string{"count", "mean", "p99"}
+	if got := fieldKeys(p); !reflect.DeepEqual(got, wantFields) {
+		t.Errorf("field keys = %v, want %v", got, wantFields)
+	}
+}
+
+func TestStatPointsLegacyLayout(t *testing.T) {
+	r := newTestReporter(t, true)
+
+	pts := r.statPoints("req.latency", "timer", testNow, map[string]float64{
+		"count": 5,
+		"mean":  1.5,
+	}, r.tags)
+
+	if len(pts) != 2 {
+		t.Fatalf("got %d points, want 2 (one point per statistic)", len(pts))
+	}
+
+	byBucket := map[string]Point{}
+	for _, p := range pts {
+		byBucket[p.Tags["bucketId"]] = p
+	}
+
+	for _, stat := range []string{"count", "mean"} {
+		p, ok := byBucket[stat]
+		if !ok {
+			t.Fatalf("no point tagged bucketId=%s", stat)
+		}
+		if p.Measurement != "metrics" {
+			t.Errorf("Measurement = %q, want %q", p.Measurement, "metrics")
+		}
+		if p.Tags["host"] != "box1" {
+			t.Errorf("Tags[host] = %q, want %q", p.Tags["host"], "box1")
+		}
+		wantField := "req.latency.timer"
+		if _, ok := p.Fields[wantField]; !ok {
+			t.Errorf("Fields = %v, want key %q", p.Fields, wantField)
+		}
+	}
+}